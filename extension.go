@@ -0,0 +1,257 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldsocache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const cacheExtensionTagHWCaps = uint32(2)
+const cacheExtensionTagISALevel = uint32(3)
+
+// Extension is implemented by typed representations of a cache
+// extension section, such as GeneratorExtension or HWCapsExtension.
+type Extension interface {
+	// Tag returns the cache extension tag this value represents.
+	Tag() uint32
+
+	// Marshal encodes the extension's section data using the given
+	// byte order.
+	Marshal(order binary.ByteOrder) ([]byte, error)
+}
+
+// ExtensionParser decodes the raw data of a cache extension section
+// into a typed Extension value.
+type ExtensionParser func(data []byte, f *File) (Extension, error)
+
+var extensionParsers = map[uint32]ExtensionParser{
+	cacheExtensionTagGenerator: parseGeneratorExtension,
+	cacheExtensionTagHWCaps:    parseHWCapsExtension,
+	cacheExtensionTagISALevel:  parseISALevelExtension,
+}
+
+// RegisterExtension registers a parser for the cache extension
+// section identified by tag, so that File.Extension (and the typed
+// accessors it backs) can decode it. Third parties can use this to
+// teach the package about extension tags it doesn't know about.
+func RegisterExtension(tag uint32, parser ExtensionParser) {
+	extensionParsers[tag] = parser
+}
+
+// Extension looks up the extension section with the given tag and
+// decodes it using the parser registered for that tag.
+func (f *File) Extension(tag uint32) (Extension, error) {
+	s := f.Section(tag)
+	if s == nil {
+		return nil, fmt.Errorf("ldsocache: no extension section for tag %d", tag)
+	}
+
+	parser, ok := extensionParsers[tag]
+	if !ok {
+		return nil, fmt.Errorf("ldsocache: no parser registered for extension tag %d", tag)
+	}
+
+	data, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	return parser(data, f)
+}
+
+// GeneratorExtension records the ldconfig version string that
+// generated the cache (cache extension tag 1).
+type GeneratorExtension struct {
+	Version string
+}
+
+func (GeneratorExtension) Tag() uint32 { return cacheExtensionTagGenerator }
+
+func (g GeneratorExtension) Marshal(binary.ByteOrder) ([]byte, error) {
+	return []byte(g.Version), nil
+}
+
+func parseGeneratorExtension(data []byte, f *File) (Extension, error) {
+	return GeneratorExtension{Version: string(bytes.TrimRight(data, "\x00"))}, nil
+}
+
+// Generator returns the cache's generator extension, if present.
+func (f *File) Generator() (*GeneratorExtension, error) {
+	ext, err := f.Extension(cacheExtensionTagGenerator)
+	if err != nil {
+		return nil, err
+	}
+
+	g, ok := ext.(GeneratorExtension)
+	if !ok {
+		return nil, fmt.Errorf("ldsocache: generator extension has unexpected type %T", ext)
+	}
+
+	return &g, nil
+}
+
+// hwCapsPairSize is the on-disk size of a single (string_offset,
+// hwcap_value) pair in a HWCapsExtension, before the trailing string
+// subsection.
+const hwCapsPairSize = 4 + 8
+
+// hwCapsHeaderSize is the on-disk size of the uint32 entry count that
+// precedes a HWCapsExtension's pairs. The string subsection that
+// follows the pairs has no reason to be a multiple of hwCapsPairSize,
+// so the pair count can't be inferred from the section's total size
+// and must be stored explicitly.
+const hwCapsHeaderSize = 4
+
+// HWCapsEntry is a single glibc-hwcaps level recorded in a
+// HWCapsExtension, e.g. the pair ("x86-64-v3", 0x4).
+type HWCapsEntry struct {
+	Name  string
+	Value uint64
+}
+
+// HWCapsExtension records the glibc-hwcaps levels referenced by the
+// cache's entries (cache extension tag 2), as written by glibc 2.33
+// and later. Its section holds a uint32 entry count, followed by an
+// array of that many (hwcaps_string_offset, hwcap_value) pairs, followed
+// by the string subsection those offsets point into.
+type HWCapsExtension struct {
+	Entries []HWCapsEntry
+}
+
+func (HWCapsExtension) Tag() uint32 { return cacheExtensionTagHWCaps }
+
+func (h HWCapsExtension) Marshal(order binary.ByteOrder) ([]byte, error) {
+	headerSize := hwCapsHeaderSize + len(h.Entries)*hwCapsPairSize
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, order, uint32(len(h.Entries))); err != nil {
+		return nil, err
+	}
+
+	var strPool []byte
+	for _, e := range h.Entries {
+		offset := uint32(headerSize + len(strPool))
+		if err := binary.Write(buf, order, offset); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, order, e.Value); err != nil {
+			return nil, err
+		}
+
+		strPool = append(strPool, append([]byte(e.Name), 0)...)
+	}
+
+	if _, err := buf.Write(strPool); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func parseHWCapsExtension(data []byte, f *File) (Extension, error) {
+	if len(data) < hwCapsHeaderSize {
+		return nil, fmt.Errorf("ldsocache: malformed hwcaps extension: size %d is smaller than the %d-byte header", len(data), hwCapsHeaderSize)
+	}
+
+	order := f.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	count := order.Uint32(data)
+	pairsEnd := hwCapsHeaderSize + int(count)*hwCapsPairSize
+	if pairsEnd > len(data) {
+		return nil, fmt.Errorf("ldsocache: malformed hwcaps extension: %d entries don't fit in a %d-byte section", count, len(data))
+	}
+
+	ext := HWCapsExtension{}
+	for i := 0; i < int(count); i++ {
+		pair := data[hwCapsHeaderSize+i*hwCapsPairSize:]
+		off := order.Uint32(pair)
+		value := order.Uint64(pair[4:])
+
+		name, err := extractShlibName(data, off)
+		if err != nil {
+			return nil, err
+		}
+
+		ext.Entries = append(ext.Entries, HWCapsEntry{Name: name, Value: value})
+	}
+
+	return ext, nil
+}
+
+// HWCaps returns the cache's glibc-hwcaps extension, if present.
+func (f *File) HWCaps() (*HWCapsExtension, error) {
+	ext, err := f.Extension(cacheExtensionTagHWCaps)
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := ext.(HWCapsExtension)
+	if !ok {
+		return nil, fmt.Errorf("ldsocache: hwcaps extension has unexpected type %T", ext)
+	}
+
+	return &h, nil
+}
+
+// ISALevelExtension records the minimum x86-64 ISA level the cache's
+// entries require (cache extension tag 3). Its section is a single
+// little/big-endian (matching the cache's ByteOrder) uint64 bitmask,
+// mirroring glibc's GNU_PROPERTY_X86_ISA_1_NEEDED values.
+type ISALevelExtension struct {
+	Level uint64
+}
+
+func (ISALevelExtension) Tag() uint32 { return cacheExtensionTagISALevel }
+
+func (l ISALevelExtension) Marshal(order binary.ByteOrder) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, order, l.Level); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseISALevelExtension(data []byte, f *File) (Extension, error) {
+	if len(data) != 8 {
+		return nil, fmt.Errorf("ldsocache: malformed ISA-level extension: size %d, want 8", len(data))
+	}
+
+	order := f.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	return ISALevelExtension{Level: order.Uint64(data)}, nil
+}
+
+// ISALevel returns the cache's ISA-level extension, if present.
+func (f *File) ISALevel() (*ISALevelExtension, error) {
+	ext, err := f.Extension(cacheExtensionTagISALevel)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := ext.(ISALevelExtension)
+	if !ok {
+		return nil, fmt.Errorf("ldsocache: ISA-level extension has unexpected type %T", ext)
+	}
+
+	return &l, nil
+}
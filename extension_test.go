@@ -0,0 +1,53 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldsocache
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HWCaps(t *testing.T) {
+	// Generated by glibc 2.36, which writes a glibc-hwcaps extension
+	// alongside the generator extension.
+	f, err := Open("testdata/ld.so.cache.hwcaps")
+	require.NoError(t, err)
+	defer f.Close()
+
+	caps, err := f.HWCaps()
+	require.NoError(t, err)
+	require.Equalf(t, []HWCapsEntry{{Name: "x86-64-v2", Value: 2}, {Name: "x86-64-v3", Value: 3}}, caps.Entries,
+		"hwcaps entries must be parsed in on-disk order")
+}
+
+func Test_HWCapsExtension_Marshal_roundTrip(t *testing.T) {
+	// Three entries, so that an accidental total size that happens to
+	// be a multiple of hwCapsPairSize can't mask a missing entry count.
+	want := HWCapsExtension{Entries: []HWCapsEntry{
+		{Name: "x86-64-v1", Value: 1},
+		{Name: "x86-64-v2", Value: 2},
+		{Name: "x86-64-v3", Value: 3},
+	}}
+
+	data, err := want.Marshal(binary.LittleEndian)
+	require.NoError(t, err)
+
+	got, err := parseHWCapsExtension(data, &File{ByteOrder: binary.LittleEndian})
+	require.NoError(t, err)
+	require.Equalf(t, want.Entries, got.(HWCapsExtension).Entries,
+		"hwcaps entries must round-trip through Marshal/parseHWCapsExtension")
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldsocache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const oldLdsoMagic = "ld.so-1.7.0"
+
+// Format identifies the on-disk layout of a ld.so.cache file.
+type Format int
+
+const (
+	// FormatNew is the modern "glibc-ld.so.cache 1.1" layout written
+	// by current glibc releases.
+	FormatNew Format = iota
+
+	// FormatOld is the legacy libc5 "ld.so-1.7.0" layout.
+	FormatOld
+
+	// FormatCompat is the "compatible layout" ldconfig still emits by
+	// default: an old-format header and entry table, followed by a
+	// new-format cache at the next 8-byte aligned offset, sharing a
+	// single string table with the old entries.
+	FormatCompat
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatOld:
+		return "old"
+	case FormatCompat:
+		return "compat"
+	default:
+		return "new"
+	}
+}
+
+// OldLDSORawCacheHeader is the header of the legacy libc5 cache
+// format.
+type OldLDSORawCacheHeader struct {
+	Magic   [11]byte
+	NumLibs uint32
+}
+
+// OldLDSORawCacheEntry is a single entry of the legacy libc5 cache
+// format; this is glibc's struct file_entry.
+type OldLDSORawCacheEntry struct {
+	Flags int32
+	Key   uint32
+	Value uint32
+}
+
+// newOldOrCompatFile parses a cache whose first bytes are the legacy
+// libc5 magic. It returns a File with Format set to FormatOld if no
+// new-format header follows the old entry table, or FormatCompat if
+// one does.
+func newOldOrCompatFile(r io.ReaderAt, order binary.ByteOrder) (*File, error) {
+	f := &File{ByteOrder: order}
+	sr := io.NewSectionReader(r, 0, 1<<63-1)
+
+	if err := binary.Read(sr, order, &f.OldHeader); err != nil {
+		return nil, fmt.Errorf("ldsocache: error reading old-format header: %w", err)
+	}
+
+	f.oldEntries = make([]OldLDSORawCacheEntry, f.OldHeader.NumLibs)
+	if err := binary.Read(sr, order, &f.oldEntries); err != nil {
+		return nil, fmt.Errorf("ldsocache: error reading old-format entry table: %w", err)
+	}
+
+	// A compatible-layout cache continues with a new-format header at
+	// the next 8-byte aligned position; a pure old-format cache ends
+	// with the old entry table.
+	pos, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	alignedPos := alignExtOffset(pos)
+
+	probe := make([]byte, len(ldsoMagic))
+	if _, err := r.ReadAt(probe, alignedPos); err != nil || string(probe) != ldsoMagic {
+		f.Format = FormatOld
+		return f, nil
+	}
+
+	if err := parseNewFormat(r, order, alignedPos, f); err != nil {
+		return nil, err
+	}
+	f.Format = FormatCompat
+	return f, nil
+}
+
+// writeOldFormat writes the legacy-format header and entry table to
+// buf using order. It is used for caches whose Format is FormatOld or
+// FormatCompat. newSectionBase is the absolute file offset the
+// new-format section will be written at (0 for a pure FormatOld
+// write), needed to derive a from-scratch old-format entry table that
+// correctly references the shared string table.
+func (f *File) writeOldFormat(buf io.Writer, order binary.ByteOrder, newSectionBase int64) error {
+	hdr := f.OldHeader
+	copy(hdr.Magic[:], oldLdsoMagic)
+
+	entries := f.oldEntries
+	if entries == nil {
+		// Building an old-format section for a cache that wasn't
+		// itself parsed from one (e.g. one built from scratch): derive
+		// it from the new-format entries, using the same cursor
+		// arithmetic WriteToOptions uses to rebuild the new-format
+		// entry table, since the two share a single string table at
+		// newSectionBase.
+		entries = make([]OldLDSORawCacheEntry, len(f.entries))
+		keys, values, _ := cacheEntryOffsets(f.entries)
+		for i, e := range f.entries {
+			entries[i] = OldLDSORawCacheEntry{
+				Flags: int32(e.Flags),
+				Key:   uint32(newSectionBase) + keys[i],
+				Value: uint32(newSectionBase) + values[i],
+			}
+		}
+	}
+	hdr.NumLibs = uint32(len(entries))
+
+	if err := binary.Write(buf, order, &hdr); err != nil {
+		return err
+	}
+	return binary.Write(buf, order, entries)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldsocache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Open_compatLayout(t *testing.T) {
+	// The "compatible layout" ldconfig emits by default on distros
+	// that still support libc5: an old-format header and entry table
+	// followed by the modern cache.
+	f, err := Open("testdata/ld.so.cache.compat")
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.Equalf(t, FormatCompat, f.Format, "a compatible-layout cache must be detected as such")
+	require.NotEmptyf(t, f.Entries(), "the new-format entries must still parse")
+	require.NotZerof(t, f.OldHeader.NumLibs, "the old-format entry table must also be retained")
+}
+
+func Test_WriteToOptions_compatLayout_roundTrip(t *testing.T) {
+	const path = "testdata/ld.so.cache.compat"
+
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	f, err := Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var got bytes.Buffer
+	_, err = f.WriteToOptions(&got, WriteOptions{Format: FormatCompat})
+	require.NoError(t, err)
+
+	require.Equalf(t, want, got.Bytes(), "an unmodified compatible-layout cache must round-trip byte-for-byte")
+}
+
+func Test_WriteToOptions_compatLayout_mutated(t *testing.T) {
+	f, err := Open("testdata/ld.so.cache.compat")
+	require.NoError(t, err)
+	defer f.Close()
+
+	f.AddEntry(LDSOCacheEntry{Name: "/usr/lib/libnew.so.1"})
+
+	var buf bytes.Buffer
+	_, err = f.WriteToOptions(&buf, WriteOptions{Format: FormatCompat})
+	require.NoError(t, err)
+
+	got, err := NewFile(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	require.Equalf(t, FormatCompat, got.Format, "the rewritten cache must still be detected as compat-layout")
+	require.Equalf(t, uint32(len(got.Entries())), got.OldHeader.NumLibs,
+		"the rebuilt old-format entry table must match the new entry count, not the stale parsed one")
+
+	var names []string
+	for _, e := range got.Entries() {
+		names = append(names, e.Name)
+	}
+	require.Containsf(t, names, "/usr/lib/libnew.so.1", "the added entry must survive a compat-layout write/reopen round-trip")
+}
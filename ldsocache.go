@@ -12,6 +12,11 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package ldsocache implements read access to the glibc dynamic linker
+// cache format (ld.so.cache), as produced by ldconfig(8). The API is
+// modeled after the standard library's debug/elf package: callers use
+// Open or NewFile to obtain a *File, then inspect its Entries and
+// extension Sections.
 package ldsocache
 
 import (
@@ -21,7 +26,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"unsafe"
 )
 
 const ldsoMagic = "glibc-ld.so.cache"
@@ -62,6 +66,14 @@ type LDSOCacheEntry struct {
 
 	OSVersion_Needed uint32
 	HWCap_Needed     uint64
+
+	// key and value are the original string-table offsets this entry
+	// was parsed with. ldconfig does not always set Key to point at
+	// Name's own offset (e.g. it may point partway into Value to
+	// split a directory from a soname), so these are preserved
+	// verbatim rather than recomputed, and are reused by WriteTo when
+	// the entry has not been rebuilt from scratch.
+	key, value uint32
 }
 
 type LDSOCacheExtensionHeader struct {
@@ -76,159 +88,324 @@ type LDSOCacheExtensionSectionHeader struct {
 	Size   uint32
 }
 
+// LDSOCacheExtensionSection represents a single section of the cache
+// extension block. Its data is backed by an io.SectionReader and is
+// not read from the underlying file until Open or Data is called.
 type LDSOCacheExtensionSection struct {
-	Header LDSOCacheExtensionSectionHeader
-	Data   []byte
+	LDSOCacheExtensionSectionHeader
+
+	sr *io.SectionReader
 }
 
-type LDSOCacheFile struct {
-	Header     LDSORawCacheHeader
-	Entries    []LDSOCacheEntry
-	Extensions []LDSOCacheExtensionSection
+// Open returns a new ReadSeeker reading the section's data.
+func (s *LDSOCacheExtensionSection) Open() io.ReadSeeker {
+	return io.NewSectionReader(s.sr, 0, 1<<63-1)
 }
 
-func (hdr *LDSORawCacheHeader) describe() {
-	fmt.Printf("Header:\n")
-	fmt.Printf("  Magic [%s]\n", hdr.Magic)
-	fmt.Printf("  Version [%s]\n", hdr.Version)
-	fmt.Printf("  %d library entries.\n", hdr.NumLibs)
-	fmt.Printf("  String table is %d bytes long.\n", hdr.StrTableSize)
+// Data reads and returns the contents of the section.
+func (s *LDSOCacheExtensionSection) Data() ([]byte, error) {
+	return io.ReadAll(s.Open())
 }
 
-func (ehdr *LDSOCacheExtensionHeader) describe() {
-	fmt.Printf("Extension header:\n")
-	fmt.Printf("  %d entries.\n", ehdr.Count)
+// File represents an open ld.so.cache file.
+type File struct {
+	Header    LDSORawCacheHeader
+	ByteOrder binary.ByteOrder
+
+	// Format is the on-disk layout the cache was parsed as. It is
+	// FormatNew for a cache built from scratch with New.
+	Format Format
+
+	// OldHeader and the entries backing it are only populated when
+	// Format is FormatOld or FormatCompat.
+	OldHeader  OldLDSORawCacheHeader
+	oldEntries []OldLDSORawCacheEntry
+
+	closer     io.Closer
+	entries    []LDSOCacheEntry
+	extensions []*LDSOCacheExtensionSection
+
+	// rawStrTable holds the string table exactly as read from disk.
+	// WriteTo reuses it verbatim so long as the entry table hasn't
+	// been mutated, rather than rebuilding a new table that would
+	// discard ldconfig's original string sharing and ordering.
+	rawStrTable     []byte
+	dirty           bool
+	extensionsDirty bool
 }
 
-func (shdr *LDSOCacheExtensionSectionHeader) describe() {
-	fmt.Printf("Extension section header:\n")
-	fmt.Printf("  Tag [%d]\n", shdr.Tag)
-	fmt.Printf("  Flags [%x]\n", shdr.Flags)
-	fmt.Printf("  Offset [%d]\n", shdr.Offset)
-	fmt.Printf("  Size [%d]\n", shdr.Size)
+// New creates an empty File for building a cache from scratch. Its
+// Format is FormatNew and its ByteOrder is binary.LittleEndian;
+// set either before writing to build a different layout.
+func New() *File {
+	f := &File{ByteOrder: binary.LittleEndian, dirty: true}
+	copy(f.Header.Magic[:], ldsoMagic)
+	copy(f.Header.Version[:], ldsoVersion)
+	return f
 }
 
-// LoadCacheFile attempts to load a cache file from disk.  When
-// successful, it returns an LDSOCacheFile pointer which contains
-// all relevant information from the cache file.
-func LoadCacheFile(path string) (*LDSOCacheFile, error) {
-	bindata, err := os.ReadFile(path)
+// Open opens the named cache file using os.Open and prepares it for
+// use as a File. The file is closed when the returned *File is
+// closed.
+func Open(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ff, err := NewFile(f)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	r := bytes.NewReader(bindata)
+	ff.closer = f
+	return ff, nil
+}
+
+// Close closes the File. If the File was created using NewFile
+// directly instead of Open, Close has no effect.
+func (f *File) Close() error {
+	var err error
+	if f.closer != nil {
+		err = f.closer.Close()
+		f.closer = nil
+	}
+	return err
+}
+
+// NewFile creates a new File for accessing a ld.so.cache binary in
+// an underlying reader. The cache is expected to start at position 0
+// in the ReaderAt.
+//
+// The cache's byte order is not recorded anywhere in the format, so
+// it is detected by trying to parse the header as little-endian
+// first (the overwhelmingly common case) and falling back to
+// big-endian if the little-endian NumLibs/StrTableSize values don't
+// leave enough data in the reader to be plausible.
+func NewFile(r io.ReaderAt) (*File, error) {
+	f, err := newFile(r, binary.LittleEndian)
+	if err == nil {
+		return f, nil
+	}
+
+	if bf, berr := newFile(r, binary.BigEndian); berr == nil {
+		return bf, nil
+	}
 
-	// TODO(kaniini): Use binary.BigEndian for BE targets.
-	header := LDSORawCacheHeader{}
-	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+	return nil, err
+}
+
+func newFile(r io.ReaderAt, order binary.ByteOrder) (*File, error) {
+	// The legacy libc5 layout (plain or "compatible") starts with its
+	// own magic instead of the modern cache's; check for it first.
+	oldMagic := make([]byte, len(oldLdsoMagic))
+	if _, err := r.ReadAt(oldMagic, 0); err == nil && string(oldMagic) == oldLdsoMagic {
+		return newOldOrCompatFile(r, order)
+	}
+
+	f := &File{ByteOrder: order}
+	if err := parseNewFormat(r, order, 0, f); err != nil {
 		return nil, err
 	}
+	f.Format = FormatNew
+	return f, nil
+}
 
-	header.describe()
+// parseNewFormat parses the modern cache layout starting at the
+// 8-byte aligned offset base within r, populating f's Header,
+// Entries and Sections. base is 0 for a standalone FormatNew cache,
+// or the offset following the old-format entry table for a
+// FormatCompat cache.
+func parseNewFormat(r io.ReaderAt, order binary.ByteOrder, base int64, f *File) error {
+	sr := io.NewSectionReader(r, base, 1<<63-1-base)
 
-	rawlibs := []LDSORawCacheEntry{}
-	for i := uint32(0); i < header.NumLibs; i++ {
-		rawlib := LDSORawCacheEntry{}
-		if err := binary.Read(r, binary.LittleEndian, &rawlib); err != nil {
-			return nil, err
-		}
+	if err := binary.Read(sr, order, &f.Header); err != nil {
+		return fmt.Errorf("ldsocache: error reading header: %w", err)
+	}
+	if string(f.Header.Magic[:]) != ldsoMagic {
+		return fmt.Errorf("ldsocache: bad magic %q", f.Header.Magic)
+	}
 
-		rawlibs = append(rawlibs, rawlib)
+	rawEntries := make([]LDSORawCacheEntry, f.Header.NumLibs)
+	if err := binary.Read(sr, order, &rawEntries); err != nil {
+		return fmt.Errorf("ldsocache: error reading entry table: %w", err)
 	}
 
-	pos, err := r.Seek(0, io.SeekCurrent)
+	strTableOffset, err := sr.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	strTableOffset += base
 
 	// The string table is a series of nul-terminated C strings.
-	strtable := make([]byte, header.StrTableSize)
-	if _, err := r.Read(strtable); err != nil {
-		return nil, err
+	strtable := make([]byte, f.Header.StrTableSize)
+	if _, err := io.ReadFull(sr, strtable); err != nil {
+		return fmt.Errorf("ldsocache: error reading string table: %w", err)
 	}
 
-	// Now build the cache index itself.
-	entries := []LDSOCacheEntry{}
-	for _, rawlib := range rawlibs {
-		entry := LDSOCacheEntry{
+	f.entries = make([]LDSOCacheEntry, 0, len(rawEntries))
+	for _, rawlib := range rawEntries {
+		name, err := extractShlibName(strtable, rawlib.Value-uint32(strTableOffset))
+		if err != nil {
+			return err
+		}
+
+		f.entries = append(f.entries, LDSOCacheEntry{
 			Flags:            rawlib.Flags,
+			Name:             name,
 			OSVersion_Needed: rawlib.OSVersion_Needed,
 			HWCap_Needed:     rawlib.HWCap_Needed,
-		}
+			key:              rawlib.Key,
+			value:            rawlib.Value,
+		})
+	}
+	f.rawStrTable = strtable
 
-		name, err := extractShlibName(strtable, rawlib.Value-uint32(pos))
-		if err != nil {
-			return nil, err
-		}
+	// Extension data begins at the next 8-byte aligned position
+	// following the string table.
+	pos, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	alignedPos := alignExtOffset(pos)
+	if _, err := sr.Seek(alignedPos, io.SeekStart); err != nil {
+		return err
+	}
 
-		entry.Name = name
+	// A cache extension block is optional; its absence is not an
+	// error.
+	var extHeader LDSOCacheExtensionHeader
+	if err := binary.Read(sr, order, &extHeader); err != nil {
+		return nil
+	}
+	if extHeader.Magic != ldsoExtensionMagic {
+		return nil
+	}
 
-		entries = append(entries, entry)
+	sectionHeaders := make([]LDSOCacheExtensionSectionHeader, extHeader.Count)
+	if err := binary.Read(sr, order, &sectionHeaders); err != nil {
+		return nil
 	}
 
-	// Extension data begins at the next 4-byte aligned position.
-	pos, err = r.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return nil, err
+	for _, sh := range sectionHeaders {
+		f.extensions = append(f.extensions, &LDSOCacheExtensionSection{
+			LDSOCacheExtensionSectionHeader: sh,
+			sr:                              io.NewSectionReader(r, int64(sh.Offset), int64(sh.Size)),
+		})
 	}
 
-	// Align to nearest 4 byte boundary.
-	alignedPos := (pos & -16) + 8
-	pos, err = r.Seek(alignedPos, io.SeekStart)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// Entries returns the library entries recorded in the cache.
+func (f *File) Entries() []LDSOCacheEntry {
+	return f.entries
+}
+
+// AddEntry appends a library entry to the cache. It marks the cache
+// dirty, so WriteTo will rebuild the entry and string tables instead
+// of reproducing the original bytes verbatim. It also discards any
+// parsed old-format entry table, so a FormatCompat write rebuilds one
+// that includes the new entry instead of reusing the stale one.
+func (f *File) AddEntry(e LDSOCacheEntry) {
+	f.entries = append(f.entries, e)
+	f.dirty = true
+	f.oldEntries = nil
+}
+
+// SetEntries replaces the cache's library entries wholesale. It marks
+// the cache dirty, so WriteTo will rebuild the entry and string
+// tables instead of reproducing the original bytes verbatim. It also
+// discards any parsed old-format entry table, so a FormatCompat write
+// rebuilds one that matches the replaced entries instead of reusing
+// the stale one.
+func (f *File) SetEntries(entries []LDSOCacheEntry) {
+	f.entries = entries
+	f.dirty = true
+	f.oldEntries = nil
+}
+
+// Section returns the extension section with the given tag, or nil
+// if the cache has no such section.
+func (f *File) Section(tag uint32) *LDSOCacheExtensionSection {
+	for _, s := range f.extensions {
+		if s.Tag == tag {
+			return s
+		}
 	}
+	return nil
+}
 
-	file := LDSOCacheFile{
-		Header:  header,
-		Entries: entries,
+// SetExtension sets (adding or replacing) the cache's extension
+// section for ext's tag, encoding it with the cache's byte order. It
+// marks the extension block dirty, so WriteTo recomputes section
+// offsets instead of reusing the original layout.
+func (f *File) SetExtension(ext Extension) error {
+	order := f.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
 	}
 
-	// Check for a cache extension section.
-	extHeader := LDSOCacheExtensionHeader{}
-	if err := binary.Read(r, binary.LittleEndian, &extHeader); err != nil {
-		return &file, nil
+	data, err := ext.Marshal(order)
+	if err != nil {
+		return err
 	}
-	if extHeader.Magic != ldsoExtensionMagic {
-		return &file, nil
+
+	section := &LDSOCacheExtensionSection{
+		LDSOCacheExtensionSectionHeader: LDSOCacheExtensionSectionHeader{
+			Tag:  ext.Tag(),
+			Size: uint32(len(data)),
+		},
+		sr: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
 	}
-	extHeader.describe()
 
-	// Parse the extension chunks we understand.
-	sections := []*LDSOCacheExtensionSection{}
-	for i := uint32(0); i < extHeader.Count; i++ {
-		sectionHeader := LDSOCacheExtensionSectionHeader{}
-		if err := binary.Read(r, binary.LittleEndian, &sectionHeader); err != nil {
-			return &file, nil
+	for i, s := range f.extensions {
+		if s.Tag == ext.Tag() {
+			f.extensions[i] = section
+			f.extensionsDirty = true
+			return nil
 		}
-		sectionHeader.describe()
-
-		section := &LDSOCacheExtensionSection{Header: sectionHeader}
-		sections = append(sections, section)
 	}
 
-	// Load extension data.
-	for _, section := range sections {
-		pos, err = r.Seek(int64(section.Header.Offset), io.SeekStart)
-		if err != nil {
-			return &file, nil
-		}
-		if pos != int64(section.Header.Offset) {
-			return &file, nil
-		}
+	f.extensions = append(f.extensions, section)
+	f.extensionsDirty = true
+	return nil
+}
 
-		section.Data = make([]byte, section.Header.Size)
-		if _, err := r.Read(section.Data); err != nil {
-			return &file, nil
-		}
+// alignExtOffset rounds pos up to the next offset congruent to 8
+// modulo 16, which is where ld.so.cache expects to find the next
+// header (the cache extension block, or a new-format cache following
+// an old-format one in the compatible layout).
+func alignExtOffset(pos int64) int64 {
+	rem := pos % 16
+	if rem <= 8 {
+		return pos + (8 - rem)
 	}
+	return pos + (24 - rem)
+}
 
-	for _, section := range sections {
-		file.Extensions = append(file.Extensions, *section)
+// cacheEntryOffsets computes the Key/Value string-table offsets a
+// freshly written new-format entry table would assign to entries, along
+// with the concatenated, nul-terminated string table backing them.
+// Value is the offset of the entry's full path; Key is the offset of
+// the path with its directory component stripped. Both are relative to
+// the start of the new-format section (the cache header immediately
+// preceding the entry table), matching what WriteToOptions writes.
+func cacheEntryOffsets(entries []LDSOCacheEntry) (keys, values []uint32, strtable []byte) {
+	fileEntryTableSize := binary.Size(LDSORawCacheHeader{}) + len(entries)*binary.Size(LDSORawCacheEntry{})
+
+	keys = make([]uint32, len(entries))
+	values = make([]uint32, len(entries))
+	for i, e := range entries {
+		cursor := uint32(fileEntryTableSize) + uint32(len(strtable))
+		strtable = append(strtable, append([]byte(e.Name), 0)...)
+
+		values[i] = cursor
+		keys[i] = cursor + uint32(len(filepath.Dir(e.Name)))
 	}
 
-	return &file, nil
+	return keys, values, strtable
 }
 
 // extractShlibName extracts a shared library from the string table.
@@ -243,102 +420,206 @@ func extractShlibName(strtable []byte, startIdx uint32) (string, error) {
 	return string(subset[:terminatorPos]), nil
 }
 
-// Write writes a cache file to disk.
-func (cf *LDSOCacheFile) Write(path string) error {
-	buf := &bytes.Buffer{}
+// DumpTo writes a human-readable description of the cache's header
+// and extension sections to w. It replaces the debug output that
+// this package used to print to stdout while parsing.
+func (f *File) DumpTo(w io.Writer) {
+	fmt.Fprintf(w, "Header:\n")
+	fmt.Fprintf(w, "  Magic [%s]\n", f.Header.Magic)
+	fmt.Fprintf(w, "  Version [%s]\n", f.Header.Version)
+	fmt.Fprintf(w, "  %d library entries.\n", f.Header.NumLibs)
+	fmt.Fprintf(w, "  String table is %d bytes long.\n", f.Header.StrTableSize)
+
+	if len(f.extensions) == 0 {
+		return
+	}
 
-	// Calculate the size of the file entry table for use
-	// when calculating the file entry string table offsets.
-	fileEntryTableSize := int(unsafe.Sizeof(LDSORawCacheHeader{}) + (uintptr(len(cf.Entries)) * unsafe.Sizeof(LDSORawCacheEntry{})))
+	fmt.Fprintf(w, "Extension header:\n")
+	fmt.Fprintf(w, "  %d entries.\n", len(f.extensions))
 
-	// Write the header section.
-	if err := cf.Header.Write(buf); err != nil {
-		return err
+	for _, ext := range f.extensions {
+		fmt.Fprintf(w, "Extension section header:\n")
+		fmt.Fprintf(w, "  Tag [%d]\n", ext.Tag)
+		fmt.Fprintf(w, "  Flags [%x]\n", ext.Flags)
+		fmt.Fprintf(w, "  Offset [%d]\n", ext.Offset)
+		fmt.Fprintf(w, "  Size [%d]\n", ext.Size)
 	}
+}
 
-	// Build the string table.
-	lrcEntries := []LDSORawCacheEntry{}
-	stringTable := []byte{}
-	for _, lib := range cf.Entries {
-		cursor := uint32(fileEntryTableSize) + uint32(len(stringTable))
-		entry := []byte(lib.Name)
-		entry = append(entry, byte(0x0))
-		stringTable = append(stringTable, entry...)
-
-		lrcEntry := LDSORawCacheEntry{
-			Flags: lib.Flags,
-			Key: cursor + uint32(len(filepath.Dir(lib.Name))),
-			Value: cursor,
-			OSVersion_Needed: lib.OSVersion_Needed,
-			HWCap_Needed: lib.HWCap_Needed,
-		}
+// WriteOptions controls the on-disk layout WriteToOptions emits.
+type WriteOptions struct {
+	// Format selects the layout to write. The zero value, FormatNew,
+	// writes only the modern cache format.
+	Format Format
+}
 
-		lrcEntries = append(lrcEntries, lrcEntry)
+// WriteTo writes the cache to w using the layout it was parsed as
+// (FormatNew for a cache built with New). It is equivalent to
+// WriteToOptions(w, WriteOptions{Format: f.Format}).
+//
+// If the cache was loaded via Open or NewFile and hasn't been
+// mutated since (no AddEntry/SetEntries/SetExtension calls), WriteTo
+// reproduces the original entry table, string table and extension
+// layout byte-for-byte; otherwise it rebuilds them from the current
+// entries and extensions.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	return f.WriteToOptions(w, WriteOptions{Format: f.Format})
+}
+
+// WriteToOptions writes the cache to w using the layout described by
+// opts, which may request a different Format than the cache was
+// loaded with.
+func (f *File) WriteToOptions(w io.Writer, opts WriteOptions) (int64, error) {
+	order := f.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
 	}
 
-	// Write the file entry table.
-	if err := binary.Write(buf, binary.LittleEndian, &lrcEntries); err != nil {
-		return err
+	buf := &bytes.Buffer{}
+
+	// newSectionBase is the absolute file offset the new-format section
+	// will start at: 0 for a standalone FormatNew cache, or the next
+	// 8-byte aligned offset following the old entry table for a
+	// FormatCompat one. It's needed up front (rather than read back
+	// from buf.Len() after the fact) because the old- and new-format
+	// entry tables of a compat cache share one string table and must
+	// agree on its absolute position.
+	var newSectionBase int64
+
+	if opts.Format == FormatOld || opts.Format == FormatCompat {
+		oldEntryCount := len(f.entries)
+		if f.oldEntries != nil {
+			oldEntryCount = len(f.oldEntries)
+		}
+		oldSectionSize := int64(binary.Size(OldLDSORawCacheHeader{})) + int64(oldEntryCount)*int64(binary.Size(OldLDSORawCacheEntry{}))
+		newSectionBase = alignExtOffset(oldSectionSize)
+
+		if err := f.writeOldFormat(buf, order, newSectionBase); err != nil {
+			return 0, err
+		}
+		if opts.Format == FormatOld {
+			return io.Copy(w, buf)
+		}
+
+		// The new-format section of a compatible-layout cache begins
+		// at the next 8-byte aligned offset following the old entries.
+		pos := int64(buf.Len())
+		if _, err := buf.Write(make([]byte, newSectionBase-pos)); err != nil {
+			return 0, err
+		}
 	}
 
-	// Write the string table.
-	if _, err := buf.Write(stringTable); err != nil {
-		return err
+	rawEntries := make([]LDSORawCacheEntry, len(f.entries))
+	var strtable []byte
+
+	if !f.dirty && f.rawStrTable != nil {
+		// Reuse the original string table and offsets verbatim so
+		// that an unmodified cache round-trips byte-for-byte.
+		strtable = f.rawStrTable
+		for i, e := range f.entries {
+			rawEntries[i] = LDSORawCacheEntry{
+				Flags:            e.Flags,
+				Key:              e.key,
+				Value:            e.value,
+				OSVersion_Needed: e.OSVersion_Needed,
+				HWCap_Needed:     e.HWCap_Needed,
+			}
+		}
+	} else {
+		var keys, values []uint32
+		keys, values, strtable = cacheEntryOffsets(f.entries)
+		for i, e := range f.entries {
+			rawEntries[i] = LDSORawCacheEntry{
+				Flags:            e.Flags,
+				Key:              uint32(newSectionBase) + keys[i],
+				Value:            uint32(newSectionBase) + values[i],
+				OSVersion_Needed: e.OSVersion_Needed,
+				HWCap_Needed:     e.HWCap_Needed,
+			}
+		}
+		f.Header.StrTableSize = uint32(len(strtable))
 	}
+	f.Header.NumLibs = uint32(len(f.entries))
 
-	pos := buf.Len()
-	fmt.Printf("pos = %d\n", pos)
+	if err := binary.Write(buf, order, &f.Header); err != nil {
+		return 0, err
+	}
 
-	alignedPos := (pos & -16) + 8
-	fmt.Printf("aligned = %d\n", alignedPos)
+	if err := binary.Write(buf, order, rawEntries); err != nil {
+		return 0, err
+	}
+	if _, err := buf.Write(strtable); err != nil {
+		return 0, err
+	}
 
-	pad := make([]byte, alignedPos - pos)
-	if _, err := buf.Write(pad); err != nil {
-		return err
+	// Pad to the next 8-byte aligned position, matching the layout
+	// NewFile expects to find the extension block at.
+	pos := int64(buf.Len())
+	alignedPos := alignExtOffset(pos)
+	if _, err := buf.Write(make([]byte, alignedPos-pos)); err != nil {
+		return 0, err
 	}
 
-	// Write the extension sections.
-	if len(cf.Extensions) > 0 {
-		ehdr := LDSOCacheExtensionHeader{
-			Magic: ldsoExtensionMagic,
-			Count: uint32(len(cf.Extensions)),
+	if len(f.extensions) > 0 {
+		if f.extensionsDirty {
+			// Lay sections out back-to-back right after the section
+			// header table, recomputing each one's recorded offset.
+			cur := int64(buf.Len()) + int64(binary.Size(LDSOCacheExtensionHeader{})) +
+				int64(len(f.extensions))*int64(binary.Size(LDSOCacheExtensionSectionHeader{}))
+			for _, ext := range f.extensions {
+				data, err := ext.Data()
+				if err != nil {
+					return 0, err
+				}
+				ext.Offset = uint32(cur)
+				ext.Size = uint32(len(data))
+				cur += int64(len(data))
+			}
 		}
 
-		if err := binary.Write(buf, binary.LittleEndian, &ehdr); err != nil {
-			return err
+		ehdr := LDSOCacheExtensionHeader{Magic: ldsoExtensionMagic, Count: uint32(len(f.extensions))}
+		if err := binary.Write(buf, order, &ehdr); err != nil {
+			return 0, err
 		}
-
-		for _, ext := range cf.Extensions {
-			if err := binary.Write(buf, binary.LittleEndian, ext.Header); err != nil {
-				return err
+		for _, ext := range f.extensions {
+			if err := binary.Write(buf, order, ext.LDSOCacheExtensionSectionHeader); err != nil {
+				return 0, err
 			}
 		}
 
-		for _, ext := range cf.Extensions {
-			if _, err := buf.Write(ext.Data); err != nil {
-				return err
+		// Sections record their own absolute file offsets; emit zero
+		// padding to reach each one instead of repacking them, so
+		// that the original inter-section alignment is preserved.
+		cur := int64(buf.Len())
+		for _, ext := range f.extensions {
+			if gap := int64(ext.Offset) - cur; gap > 0 {
+				buf.Write(make([]byte, gap))
+				cur += gap
+			}
+
+			data, err := ext.Data()
+			if err != nil {
+				return 0, err
+			}
+			if _, err := buf.Write(data); err != nil {
+				return 0, err
 			}
+			cur += int64(len(data))
 		}
 	}
 
+	return io.Copy(w, buf)
+}
+
+// Write writes the cache to the named file, creating it if it
+// doesn't already exist.
+func (f *File) Write(path string) error {
 	w, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	if _, err := io.Copy(w, buf); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Write writes a header for a cache file to disk.
-func (hdr *LDSORawCacheHeader) Write(w io.Writer) error {
-	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
-		return err
-	}
-
-	return nil
+	_, err = f.WriteTo(w)
+	return err
 }
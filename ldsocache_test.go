@@ -1,19 +1,75 @@
 package ldsocache
 
 import (
+	"bytes"
+	"encoding/binary"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
-func Test_LoadCacheFile(t *testing.T) {
-	cacheFile, err := LoadCacheFile("testdata/ld.so.cache")
+func Test_Open(t *testing.T) {
+	f, err := Open("testdata/ld.so.cache")
 	require.NoError(t, err)
-	require.Equalf(t, uint32(65), cacheFile.Header.NumLibs, "there should be 65 libraries in this cache file")
-	require.Equalf(t, uint32(1421), cacheFile.Header.StrTableSize, "the string table should be 1421 bytes long")
-	require.Equalf(t, 1, len(cacheFile.Extensions), "there must be 1 extension")
+	defer f.Close()
 
-	ext := cacheFile.Extensions[0]
-	require.Equalf(t, uint32(0), ext.Header.Tag, "extension data must be tag 0 (generator)")
-	require.Equalf(t, []byte("ldconfig (GNU libc) stable release version 2.36"), ext.Data, "must be generated by glibc 2.36")
+	require.Equalf(t, uint32(2), f.Header.NumLibs, "there should be 2 libraries in this cache file")
+	require.Equalf(t, uint32(34), f.Header.StrTableSize, "the string table should be 34 bytes long")
+	require.Lenf(t, f.Entries(), 2, "Entries() should return one entry per library")
+
+	gen, err := f.Generator()
+	require.NoError(t, err)
+	require.Equalf(t, "ldconfig (GNU libc) stable release version 2.38", gen.Version, "must be generated by glibc 2.38")
+}
+
+func Test_Open_bigEndian(t *testing.T) {
+	// A cache generated on a big-endian target, e.g. s390x.
+	f, err := Open("testdata/ld.so.cache.s390x")
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.Equalf(t, binary.BigEndian, f.ByteOrder, "a big-endian cache must be detected as such")
+	require.NotEmptyf(t, f.Entries(), "the big-endian cache must still parse its entries")
+}
+
+func Test_WriteTo_roundTrip(t *testing.T) {
+	// Shares its fixture with Test_Open above.
+	const path = "testdata/ld.so.cache"
+
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	f, err := Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var got bytes.Buffer
+	_, err = f.WriteTo(&got)
+	require.NoError(t, err)
+
+	require.Equalf(t, want, got.Bytes(), "an unmodified cache must round-trip byte-for-byte")
+}
+
+func Test_New_AddEntry_WriteTo_roundTrip(t *testing.T) {
+	f := New()
+	f.AddEntry(LDSOCacheEntry{Name: "/lib/liba.so.1"})
+	f.AddEntry(LDSOCacheEntry{Name: "/usr/lib/libb.so.2"})
+
+	var buf bytes.Buffer
+	_, err := f.WriteTo(&buf)
+	require.NoError(t, err)
+
+	got, err := NewFile(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	require.Equalf(t, uint32(2), got.Header.NumLibs, "the written header must record the entries that were added")
+	require.NotZerof(t, got.Header.StrTableSize, "the written header must record a non-empty string table")
+
+	names := make([]string, len(got.Entries()))
+	for i, e := range got.Entries() {
+		names[i] = e.Name
+	}
+	require.Equalf(t, []string{"/lib/liba.so.1", "/usr/lib/libb.so.2"}, names,
+		"entries added with AddEntry must survive a write/reopen round-trip")
 }